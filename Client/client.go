@@ -1,40 +1,279 @@
 package main
 
 import (
-	"encoding/json"
+	"bufio"
+	"crypto/rand"
+	"flag"
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/nacl/box"
+
+	"github.com/joshuaparmenter/UNITE/config"
+	"github.com/joshuaparmenter/UNITE/keys"
+	"github.com/joshuaparmenter/UNITE/wire"
 )
 
-type Message struct {
-	User string `json:"user"`
-	Text string `json:"text"`
+// safeConn serializes writes to conn so the dm-sending loop, incoming-dm
+// decryption goroutines, and lookups never interleave frames. ndjson
+// selects the same line-delimited framing used on the read side by
+// printIncoming.
+type safeConn struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	ndjson bool
+}
+
+func (s *safeConn) send(msg wire.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ndjson {
+		return wire.WriteMessageLine(s.conn, msg)
+	}
+	return wire.WriteMessage(s.conn, msg)
 }
 
 func main() {
-	host := "127.0.0.1:5000"
-	conn, err := net.Dial("tcp", host)
+	ndjson := flag.Bool("ndjson", false, "speak newline-delimited JSON instead of length-prefixed frames, to match a server started with -ndjson")
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 1 {
+		fmt.Println("usage: client [-ndjson] <nickname> [recipient]")
+		os.Exit(1)
+	}
+	nick := args[0]
+	var to string
+	if len(args) > 1 {
+		to = args[1]
+	}
+
+	cfgPath, err := config.DefaultPath()
 	if err != nil {
 		panic(err)
 	}
-	defer conn.Close()
+	cfg, err := config.Load(cfgPath)
+	if err != nil {
+		fmt.Printf("couldn't load %s: %v\n", cfgPath, err)
+		fmt.Println("copy the connection code from the server's config file there first")
+		os.Exit(1)
+	}
 
-	// create some placeholder JSON data
-	msg := Message{
-		User: "Alice",
-		Text: "Hello server!",
+	home, err := os.UserHomeDir()
+	if err != nil {
+		panic(err)
 	}
+	identityPath := filepath.Join(home, ".unite", nick+".key")
+
+	stdin := bufio.NewScanner(os.Stdin)
 
-	data, err := json.Marshal(msg)
+	fmt.Print("Passphrase for local identity: ")
+	stdin.Scan()
+	passphrase := stdin.Text()
+
+	pub, priv, err := keys.LoadOrGenerate(identityPath, passphrase)
 	if err != nil {
 		panic(err)
 	}
 
-	// send JSON as binary
-	_, err = conn.Write(data)
+	rawConn, err := net.Dial("tcp", "127.0.0.1:5000")
 	if err != nil {
 		panic(err)
 	}
+	defer rawConn.Close()
+	conn := &safeConn{conn: rawConn, ndjson: *ndjson}
+
+	// Read the handshake replies ourselves, on the same scanner we then
+	// hand to printIncoming, rather than letting that goroutine's read
+	// loop see them: a stale connection code or taken nickname must stop
+	// us before we ever claim to be connected.
+	var scanner *bufio.Scanner
+	if *ndjson {
+		scanner = wire.NewLineScanner(rawConn, wire.DefaultMaxReadBytes)
+	}
+	readReply := func() (wire.Message, error) {
+		if *ndjson {
+			return wire.ReadMessageLine(scanner)
+		}
+		return wire.ReadMessage(rawConn, wire.DefaultMaxReadBytes)
+	}
+
+	if err := conn.send(wire.Message{Type: "auth", Code: cfg.ConnectionCode}); err != nil {
+		panic(err)
+	}
+	reply, err := readReply()
+	if err != nil {
+		fmt.Println("auth failed:", err)
+		os.Exit(1)
+	}
+	if reply.Type != "ack" {
+		fmt.Println("auth failed:", reply.Text)
+		os.Exit(1)
+	}
+
+	if err := conn.send(wire.Message{Type: "register", User: nick, PublicKey: pub[:]}); err != nil {
+		panic(err)
+	}
+	reply, err = readReply()
+	if err != nil {
+		fmt.Println("register failed:", err)
+		os.Exit(1)
+	}
+	if reply.Type != "ack" {
+		fmt.Println("register failed:", reply.Text)
+		os.Exit(1)
+	}
+
+	dir := newKeyDirectory()
+	go printIncoming(rawConn, scanner, conn, dir, priv, *ndjson)
 
-	fmt.Println("JSON sent!")
+	fmt.Printf("Registered as %s. Type messages to send", nick)
+	if to != "" {
+		fmt.Printf(" to %s", to)
+	}
+	fmt.Println(".")
+
+	for stdin.Scan() {
+		if to == "" {
+			fmt.Println("no recipient set, pass one as the second argument")
+			continue
+		}
+		toKey, err := dir.lookup(conn, to)
+		if err != nil {
+			fmt.Println("lookup error:", err)
+			continue
+		}
+
+		var nonce [24]byte
+		if _, err := rand.Read(nonce[:]); err != nil {
+			panic(err)
+		}
+		sealed := box.Seal(nil, stdin.Bytes(), &nonce, toKey, priv)
+
+		if err := conn.send(wire.Message{Type: "dm", To: to, Nonce: nonce[:], Ciphertext: sealed}); err != nil {
+			fmt.Println("send error:", err)
+			return
+		}
+	}
+}
+
+// keyDirectory caches recipients' public keys, fetching each one from
+// the server's "lookup" endpoint at most once.
+type keyDirectory struct {
+	mu      sync.Mutex
+	keys    map[string]*[32]byte
+	waiters map[string][]chan wire.Message
+}
+
+func newKeyDirectory() *keyDirectory {
+	return &keyDirectory{
+		keys:    make(map[string]*[32]byte),
+		waiters: make(map[string][]chan wire.Message),
+	}
+}
+
+// lookup returns nick's cached public key, fetching it from the server
+// if this is the first time we've needed it. Concurrent lookups for the
+// same nick share one round trip: only the first caller sends a
+// "lookup" request, and every caller queues its own reply channel so
+// deliver can wake them all. It must never be called from the goroutine
+// that reads conn, since the reply it waits on is delivered by that same
+// goroutine via deliver.
+func (d *keyDirectory) lookup(conn *safeConn, nick string) (*[32]byte, error) {
+	d.mu.Lock()
+	if key, ok := d.keys[nick]; ok {
+		d.mu.Unlock()
+		return key, nil
+	}
+	ch := make(chan wire.Message, 1)
+	first := len(d.waiters[nick]) == 0
+	d.waiters[nick] = append(d.waiters[nick], ch)
+	d.mu.Unlock()
+
+	if first {
+		if err := conn.send(wire.Message{Type: "lookup", To: nick}); err != nil {
+			return nil, err
+		}
+	}
+
+	reply := <-ch
+	if reply.Text != "" {
+		return nil, fmt.Errorf("%s", reply.Text)
+	}
+
+	var key [32]byte
+	copy(key[:], reply.PublicKey)
+
+	d.mu.Lock()
+	d.keys[nick] = &key
+	d.mu.Unlock()
+	return &key, nil
+}
+
+// deliver routes a "lookup" reply from the server to every goroutine
+// waiting on it, matched by the nickname it was asked about.
+func (d *keyDirectory) deliver(msg wire.Message) {
+	d.mu.Lock()
+	chans := d.waiters[msg.To]
+	delete(d.waiters, msg.To)
+	d.mu.Unlock()
+	for _, ch := range chans {
+		ch <- msg
+	}
+}
+
+// printIncoming prints every message the server sends us until the
+// connection closes, opening encrypted dm payloads as they arrive.
+// ndjson must match the server's -ndjson setting.
+func printIncoming(rawConn net.Conn, scanner *bufio.Scanner, conn *safeConn, dir *keyDirectory, priv *[32]byte, ndjson bool) {
+	for {
+		var msg wire.Message
+		var err error
+		if ndjson {
+			msg, err = wire.ReadMessageLine(scanner)
+		} else {
+			msg, err = wire.ReadMessage(rawConn, wire.DefaultMaxReadBytes)
+		}
+		if err != nil {
+			return
+		}
+		switch msg.Type {
+		case "dm":
+			go decryptAndPrint(conn, dir, priv, msg)
+		case "lookup":
+			dir.deliver(msg)
+		case "broadcast":
+			fmt.Printf("* %s\n", msg.Text)
+		case "ack":
+			fmt.Printf("(ok) %s\n", msg.Text)
+		case "error":
+			fmt.Printf("(error) %s\n", msg.Text)
+		case "shutdown":
+			fmt.Println("server is shutting down")
+			os.Exit(0)
+		}
+	}
+}
+
+// decryptAndPrint looks up the sender's public key (round-tripping to
+// the server if we haven't seen it before) and opens the sealed payload.
+// It runs in its own goroutine so a cache-miss lookup never blocks the
+// connection's read loop, which is what delivers the lookup's reply.
+func decryptAndPrint(conn *safeConn, dir *keyDirectory, priv *[32]byte, msg wire.Message) {
+	fromKey, err := dir.lookup(conn, msg.From)
+	if err != nil {
+		fmt.Println("can't decrypt, lookup failed:", err)
+		return
+	}
+	var nonce [24]byte
+	copy(nonce[:], msg.Nonce)
+	plain, ok := box.Open(nil, msg.Ciphertext, &nonce, fromKey, priv)
+	if !ok {
+		fmt.Println("message from", msg.From, "failed to decrypt")
+		return
+	}
+	fmt.Printf("[%s] %s\n", msg.From, string(plain))
 }
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/joshuaparmenter/UNITE/config"
+	"github.com/joshuaparmenter/UNITE/store"
+	"github.com/joshuaparmenter/UNITE/wire"
+)
+
+// authWindow is the default for Server.AuthWindow: how long a connection
+// has to complete the auth handshake before the server gives up on it.
+const authWindow = 5 * time.Second
+
+// client represents one connected, possibly still-unregistered socket.
+// pubKey is the client's NaCl box public key, published during register
+// so others can look it up to seal messages to it; the server itself
+// never sees message plaintext once clients encrypt end-to-end.
+type client struct {
+	conn   net.Conn
+	nick   string
+	pubKey []byte
+	out    chan wire.Message
+}
+
+// registry is a concurrent-safe directory of nickname -> client.
+type registry struct {
+	mu      sync.RWMutex
+	clients map[string]*client
+}
+
+func newRegistry() *registry {
+	return &registry{clients: make(map[string]*client)}
+}
+
+// register claims nick for c, failing if it is already taken.
+func (r *registry) register(nick string, c *client) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, taken := r.clients[nick]; taken {
+		return false
+	}
+	r.clients[nick] = c
+	return true
+}
+
+func (r *registry) unregister(nick string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.clients, nick)
+}
+
+func (r *registry) lookup(nick string) (*client, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	c, ok := r.clients[nick]
+	return c, ok
+}
+
+// broadcast fans a message out to every registered client.
+func (r *registry) broadcast(msg wire.Message) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, c := range r.clients {
+		select {
+		case c.out <- msg:
+		default:
+			// slow reader; drop rather than block the registry
+		}
+	}
+}
+
+// liveConns tracks every connection handleConn is currently serving,
+// from the moment it is accepted until it returns — unlike registry,
+// which only knows about connections that completed "register". This is
+// what shutdown walks, so a peer stuck mid-auth isn't left running past
+// the server's own exit.
+type liveConns struct {
+	mu    sync.Mutex
+	conns map[net.Conn]*client
+}
+
+func newLiveConns() *liveConns {
+	return &liveConns{conns: make(map[net.Conn]*client)}
+}
+
+func (l *liveConns) add(conn net.Conn, c *client) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.conns[conn] = c
+}
+
+func (l *liveConns) remove(conn net.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.conns, conn)
+}
+
+// shutdownAll queues a shutdown frame for every live connection, then
+// forces its next read to fail so handleConn's own exit path runs:
+// close(c.out) only happens after this frame is queued, and wg.Wait()
+// there makes sure writeLoop has flushed it before conn.Close() is ever
+// called. shutdownAll itself never touches conn directly, so there is no
+// race between a write in flight and the socket closing underneath it.
+func (l *liveConns) shutdownAll() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for conn, c := range l.conns {
+		select {
+		case c.out <- wire.Message{Type: "shutdown"}:
+		default:
+		}
+		conn.SetReadDeadline(time.Now())
+	}
+}
+
+// authTracker records which connections have completed the auth
+// handshake. It is separate from registry because a connection is
+// tracked here before it has a nickname to register under.
+type authTracker struct {
+	mu     sync.Mutex
+	authed map[net.Conn]bool
+}
+
+func newAuthTracker() *authTracker {
+	return &authTracker{authed: make(map[net.Conn]bool)}
+}
+
+func (t *authTracker) mark(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.authed[conn] = true
+}
+
+func (t *authTracker) isAuthed(conn net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.authed[conn]
+}
+
+func (t *authTracker) forget(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.authed, conn)
+}
+
+// Server is a UNITE chat server listening on Addr. IdleTimeout, if
+// non-zero, closes connections that send nothing for that long.
+// ConnectionCode is the pre-shared secret every client must present
+// before the server accepts any other message, within AuthWindow of
+// connecting. Store, if set, queues dms sent to offline users for
+// delivery on their next register. MaxReadBytes caps the size of a
+// single incoming frame; a zero value disables the check.
+type Server struct {
+	Addr           string
+	IdleTimeout    time.Duration
+	ConnectionCode string
+	AuthWindow     time.Duration
+	MaxReadBytes   uint32
+	NDJSON         bool
+	Store          store.Store
+
+	// Listening, if non-nil, is closed once the listener is bound, after
+	// Addr has been updated to its actual address. Tests bind to
+	// "127.0.0.1:0" and use this to learn the port the OS picked.
+	Listening chan struct{}
+
+	reg  *registry
+	auth *authTracker
+	live *liveConns
+}
+
+func NewServer(addr string, idleTimeout time.Duration, connectionCode string, st store.Store) *Server {
+	return &Server{
+		Addr:           addr,
+		IdleTimeout:    idleTimeout,
+		ConnectionCode: connectionCode,
+		AuthWindow:     authWindow,
+		MaxReadBytes:   wire.DefaultMaxReadBytes,
+		Store:          st,
+		reg:            newRegistry(),
+		auth:           newAuthTracker(),
+		live:           newLiveConns(),
+	}
+}
+
+// Run listens and serves until ctx is cancelled, at which point it tells
+// every connected client the server is shutting down, closes their
+// connections, and returns.
+func (s *Server) Run(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	s.Addr = ln.Addr().String()
+	if s.Listening != nil {
+		close(s.Listening)
+	}
+	fmt.Println("Server listening on", s.Addr)
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+		s.live.shutdownAll()
+	}()
+
+	var wg sync.WaitGroup
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				wg.Wait()
+				return nil
+			default:
+				fmt.Println("accept error:", err)
+				continue
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handleConn(ctx, conn)
+		}()
+	}
+}
+
+func (s *Server) handleConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	c := &client{conn: conn, out: make(chan wire.Message, 16)}
+
+	s.live.add(conn, c)
+	defer s.live.remove(conn)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		writeLoop(conn, c.out, s.NDJSON)
+	}()
+	defer func() {
+		close(c.out)
+		wg.Wait()
+		s.auth.forget(conn)
+	}()
+
+	var scanner *bufio.Scanner
+	if s.NDJSON {
+		scanner = wire.NewLineScanner(conn, s.MaxReadBytes)
+	}
+
+	authDeadline := time.AfterFunc(s.AuthWindow, func() {
+		if !s.auth.isAuthed(conn) {
+			conn.Close()
+		}
+	})
+	defer authDeadline.Stop()
+
+readLoop:
+	for {
+		select {
+		case <-ctx.Done():
+			// Server is shutting down: don't re-arm the idle deadline
+			// shutdownAll just used to unblock our read below.
+			break readLoop
+		default:
+		}
+
+		if s.IdleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(s.IdleTimeout))
+		}
+
+		var msg wire.Message
+		var err error
+		if s.NDJSON {
+			msg, err = wire.ReadMessageLine(scanner)
+		} else {
+			msg, err = wire.ReadMessage(conn, s.MaxReadBytes)
+		}
+		if err != nil {
+			break
+		}
+
+		if !s.auth.isAuthed(conn) {
+			if msg.Type != "auth" || subtle.ConstantTimeCompare([]byte(msg.Code), []byte(s.ConnectionCode)) != 1 {
+				c.out <- wire.Message{Type: "error", Text: "authentication required"}
+				break
+			}
+			s.auth.mark(conn)
+			c.out <- wire.Message{Type: "ack", Text: "authenticated"}
+			continue
+		}
+
+		switch msg.Type {
+		case "register":
+			if c.nick != "" {
+				c.out <- wire.Message{Type: "error", Text: "already registered"}
+				continue
+			}
+			// Set these before registering: once c is visible in the
+			// registry, other connections' goroutines can read them
+			// through lookup without synchronization of their own.
+			c.pubKey = msg.PublicKey
+			c.nick = msg.User
+			if !s.reg.register(msg.User, c) {
+				c.nick = ""
+				c.out <- wire.Message{Type: "error", Text: "nickname taken"}
+				continue
+			}
+			c.out <- wire.Message{Type: "ack", Text: "registered as " + c.nick}
+			s.reg.broadcast(wire.Message{Type: "broadcast", User: "server", Text: c.nick + " joined"})
+
+			if s.Store != nil {
+				pending, err := s.Store.Drain(c.nick)
+				if err != nil {
+					fmt.Println("drain error for", c.nick, ":", err)
+				}
+				for _, m := range pending {
+					c.out <- m
+				}
+			}
+
+		case "lookup":
+			to, ok := s.reg.lookup(msg.To)
+			if !ok {
+				c.out <- wire.Message{Type: "lookup", To: msg.To, Text: msg.To + " is offline"}
+				continue
+			}
+			c.out <- wire.Message{Type: "lookup", To: to.nick, From: to.nick, PublicKey: to.pubKey}
+
+		case "dm":
+			if c.nick == "" {
+				c.out <- wire.Message{Type: "error", Text: "register before sending messages"}
+				continue
+			}
+			msg.From = c.nick
+			to, ok := s.reg.lookup(msg.To)
+			if !ok {
+				if s.Store != nil {
+					if err := s.Store.Enqueue(msg.To, msg); err == nil {
+						c.out <- wire.Message{Type: "ack", Text: msg.To + " is offline, message queued"}
+						continue
+					}
+				}
+				c.out <- wire.Message{Type: "error", Text: msg.To + " is offline"}
+				continue
+			}
+			to.out <- msg
+
+		default:
+			c.out <- wire.Message{Type: "error", Text: "unknown message type " + msg.Type}
+		}
+	}
+
+	if c.nick != "" {
+		s.reg.unregister(c.nick)
+		s.reg.broadcast(wire.Message{Type: "broadcast", User: "server", Text: c.nick + " left"})
+	}
+}
+
+// writeLoop serializes every write to conn so concurrent senders (the
+// registry broadcasting, another client's dm) never interleave bytes on
+// the same socket. ndjson selects the same line-delimited framing used
+// on the read side by handleConn.
+func writeLoop(conn net.Conn, out <-chan wire.Message, ndjson bool) {
+	for msg := range out {
+		var err error
+		if ndjson {
+			err = wire.WriteMessageLine(conn, msg)
+		} else {
+			err = wire.WriteMessage(conn, msg)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func main() {
+	ndjson := flag.Bool("ndjson", false, "speak newline-delimited JSON instead of length-prefixed frames, so a connection can be driven from telnet")
+	storePath := flag.String("store", "", "path to a BoltDB file persisting the offline message queue across restarts; empty uses an in-memory queue")
+	flag.Parse()
+
+	cfgPath, err := config.DefaultPath()
+	if err != nil {
+		panic(err)
+	}
+	cfg, err := config.LoadOrCreate(cfgPath)
+	if err != nil {
+		panic(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		fmt.Println("shutting down...")
+		cancel()
+	}()
+
+	const (
+		maxQueuedPerUser = 100
+		queueTTL         = 7 * 24 * time.Hour
+	)
+	var st store.Store
+	if *storePath != "" {
+		bolt, err := store.OpenBolt(*storePath, maxQueuedPerUser, queueTTL)
+		if err != nil {
+			panic(err)
+		}
+		defer bolt.Close()
+		st = bolt
+	} else {
+		st = store.NewMemory(maxQueuedPerUser, queueTTL)
+	}
+
+	srv := NewServer("127.0.0.1:5000", 5*time.Minute, cfg.ConnectionCode, st)
+	srv.NDJSON = *ndjson
+	if err := srv.Run(ctx); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/joshuaparmenter/UNITE/store"
+	"github.com/joshuaparmenter/UNITE/wire"
+)
+
+const testConnectionCode = "testcode"
+
+// startTestServer runs a Server on an OS-assigned port until the
+// returned stop func is called, and returns once it's actually
+// accepting connections.
+func startTestServer(t *testing.T, configure func(*Server)) *Server {
+	t.Helper()
+
+	srv := NewServer("127.0.0.1:0", 0, testConnectionCode, store.NewMemory(100, time.Hour))
+	srv.Listening = make(chan struct{})
+	if configure != nil {
+		configure(srv)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		srv.Run(ctx)
+		close(done)
+	}()
+
+	<-srv.Listening
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return srv
+}
+
+func readReply(t *testing.T, conn net.Conn) wire.Message {
+	t.Helper()
+	msg, err := wire.ReadMessage(conn, wire.DefaultMaxReadBytes)
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	return msg
+}
+
+// dialAndRegister completes the auth+register handshake for nick and
+// fails the test unless both are acked.
+func dialAndRegister(t *testing.T, addr, nick string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	if err := wire.WriteMessage(conn, wire.Message{Type: "auth", Code: testConnectionCode}); err != nil {
+		t.Fatalf("WriteMessage(auth): %v", err)
+	}
+	if msg := readReply(t, conn); msg.Type != "ack" {
+		t.Fatalf("auth reply = %+v, want ack", msg)
+	}
+	if err := wire.WriteMessage(conn, wire.Message{Type: "register", User: nick}); err != nil {
+		t.Fatalf("WriteMessage(register): %v", err)
+	}
+	if msg := readReply(t, conn); msg.Type != "ack" {
+		t.Fatalf("register reply = %+v, want ack", msg)
+	}
+	return conn
+}
+
+func TestDuplicateRegisterRejected(t *testing.T) {
+	srv := startTestServer(t, nil)
+
+	conn1 := dialAndRegister(t, srv.Addr, "alice")
+	defer conn1.Close()
+
+	conn2, err := net.Dial("tcp", srv.Addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn2.Close()
+	if err := wire.WriteMessage(conn2, wire.Message{Type: "auth", Code: testConnectionCode}); err != nil {
+		t.Fatalf("WriteMessage(auth): %v", err)
+	}
+	if msg := readReply(t, conn2); msg.Type != "ack" {
+		t.Fatalf("auth reply = %+v, want ack", msg)
+	}
+
+	if err := wire.WriteMessage(conn2, wire.Message{Type: "register", User: "alice"}); err != nil {
+		t.Fatalf("WriteMessage(register): %v", err)
+	}
+	if msg := readReply(t, conn2); msg.Type != "error" {
+		t.Fatalf("register with taken nick = %+v, want error", msg)
+	}
+}
+
+func TestNonAuthMessageBeforeAuthRejected(t *testing.T) {
+	srv := startTestServer(t, nil)
+
+	conn, err := net.Dial("tcp", srv.Addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	if err := wire.WriteMessage(conn, wire.Message{Type: "register", User: "alice"}); err != nil {
+		t.Fatalf("WriteMessage(register): %v", err)
+	}
+	if msg := readReply(t, conn); msg.Type != "error" {
+		t.Fatalf("unauthenticated register = %+v, want error", msg)
+	}
+	if _, err := wire.ReadMessage(conn, wire.DefaultMaxReadBytes); err == nil {
+		t.Fatal("connection stayed open after rejecting an unauthenticated message, want it closed")
+	}
+}
+
+func TestAuthWindowExpiryClosesConnection(t *testing.T) {
+	srv := startTestServer(t, func(s *Server) {
+		s.AuthWindow = 50 * time.Millisecond
+	})
+
+	conn, err := net.Dial("tcp", srv.Addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := wire.ReadMessage(conn, wire.DefaultMaxReadBytes); err == nil {
+		t.Fatal("connection stayed open past AuthWindow without auth, want it closed")
+	}
+}
+
+func TestIdleTimeoutClosesConnection(t *testing.T) {
+	srv := startTestServer(t, func(s *Server) {
+		s.IdleTimeout = 50 * time.Millisecond
+	})
+
+	conn := dialAndRegister(t, srv.Addr, "alice")
+	defer conn.Close()
+	readReply(t, conn) // the "alice joined" broadcast sent to alice herself
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := wire.ReadMessage(conn, wire.DefaultMaxReadBytes); err == nil {
+		t.Fatal("connection stayed open past IdleTimeout with no traffic, want it closed")
+	}
+}
+
+func TestShutdownDeliversFrameBeforeClosing(t *testing.T) {
+	srv := NewServer("127.0.0.1:0", 0, testConnectionCode, store.NewMemory(100, time.Hour))
+	srv.Listening = make(chan struct{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		srv.Run(ctx)
+		close(done)
+	}()
+	<-srv.Listening
+
+	conn := dialAndRegister(t, srv.Addr, "alice")
+	defer conn.Close()
+	readReply(t, conn) // the "alice joined" broadcast sent to alice herself
+
+	cancel()
+	<-done
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if msg := readReply(t, conn); msg.Type != "shutdown" {
+		t.Fatalf("message after server shutdown = %+v, want shutdown", msg)
+	}
+}
+
+func TestDMToOfflineUserErrorsWithoutStore(t *testing.T) {
+	srv := startTestServer(t, func(s *Server) {
+		s.Store = nil
+	})
+
+	conn := dialAndRegister(t, srv.Addr, "alice")
+	defer conn.Close()
+	readReply(t, conn) // the "alice joined" broadcast sent to alice herself
+
+	if err := wire.WriteMessage(conn, wire.Message{Type: "dm", To: "bob", Text: "hi"}); err != nil {
+		t.Fatalf("WriteMessage(dm): %v", err)
+	}
+	if msg := readReply(t, conn); msg.Type != "error" {
+		t.Fatalf("dm to offline user with no Store = %+v, want error", msg)
+	}
+}
+
+func TestDMToOfflineUserQueuesWithStore(t *testing.T) {
+	srv := startTestServer(t, nil)
+
+	alice := dialAndRegister(t, srv.Addr, "alice")
+	defer alice.Close()
+	readReply(t, alice) // the "alice joined" broadcast sent to alice herself
+
+	if err := wire.WriteMessage(alice, wire.Message{Type: "dm", To: "bob", Text: "hi"}); err != nil {
+		t.Fatalf("WriteMessage(dm): %v", err)
+	}
+	if msg := readReply(t, alice); msg.Type != "ack" {
+		t.Fatalf("dm to offline user with a Store = %+v, want ack (queued)", msg)
+	}
+
+	bob := dialAndRegister(t, srv.Addr, "bob")
+	defer bob.Close()
+	readReply(t, bob) // the "bob joined" broadcast sent to bob himself
+	if msg := readReply(t, bob); msg.Type != "dm" || msg.Text != "hi" {
+		t.Fatalf("queued dm delivered on register = %+v, want the dm from alice", msg)
+	}
+}
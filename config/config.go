@@ -0,0 +1,78 @@
+// Package config loads the shared UNITE config file, which currently
+// holds only the pre-shared connection code used by the auth handshake.
+package config
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Config is the on-disk shape of ~/.unite/config.json.
+type Config struct {
+	ConnectionCode string `json:"connection_code"`
+}
+
+// DefaultPath returns ~/.unite/config.json for the current user.
+func DefaultPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".unite", "config.json"), nil
+}
+
+// Load reads and parses the config file at path.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("config: parsing %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// LoadOrCreate loads the config at path, generating a fresh 32-byte
+// connection code and writing it there if the file does not exist yet.
+func LoadOrCreate(path string) (*Config, error) {
+	cfg, err := Load(path)
+	if err == nil {
+		return cfg, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	code, err := generateCode()
+	if err != nil {
+		return nil, err
+	}
+	cfg = &Config{ConnectionCode: code}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// generateCode returns a base64-encoded 32-byte random connection code.
+func generateCode() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf), nil
+}
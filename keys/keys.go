@@ -0,0 +1,117 @@
+// Package keys manages each client's long-term Curve25519 identity used
+// for end-to-end encrypted messaging, persisting the private half to
+// disk encrypted with a passphrase.
+package keys
+
+import (
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	scryptN  = 1 << 15
+	scryptR  = 8
+	scryptP  = 1
+	saltSize = 16
+)
+
+// LoadOrGenerate returns the Curve25519 keypair stored at path, which is
+// decrypted with passphrase. If no file exists yet, a fresh keypair is
+// generated and persisted there, encrypted with passphrase.
+func LoadOrGenerate(path, passphrase string) (pub, priv *[32]byte, err error) {
+	priv, err = loadPrivateKey(path, passphrase)
+	if errors.Is(err, os.ErrNotExist) {
+		pub, priv, err = box.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := savePrivateKey(path, priv, passphrase); err != nil {
+			return nil, nil, err
+		}
+		return pub, priv, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pub = new([32]byte)
+	curve25519.ScalarBaseMult(pub, priv)
+	return pub, priv, nil
+}
+
+// savePrivateKey encrypts priv with a key derived from passphrase via
+// scrypt and writes salt || nonce || sealed-box to path.
+func savePrivateKey(path string, priv *[32]byte, passphrase string) error {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	key, err := deriveKey(passphrase, salt)
+	if err != nil {
+		return err
+	}
+
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return err
+	}
+
+	sealed := secretbox.Seal(nil, priv[:], &nonce, &key)
+
+	out := make([]byte, 0, len(salt)+len(nonce)+len(sealed))
+	out = append(out, salt...)
+	out = append(out, nonce[:]...)
+	out = append(out, sealed...)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, out, 0o600)
+}
+
+func loadPrivateKey(path, passphrase string) (*[32]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < saltSize+24 {
+		return nil, errors.New("keys: identity file is truncated")
+	}
+
+	salt := data[:saltSize]
+	var nonce [24]byte
+	copy(nonce[:], data[saltSize:saltSize+24])
+	sealed := data[saltSize+24:]
+
+	key, err := deriveKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	opened, ok := secretbox.Open(nil, sealed, &nonce, &key)
+	if !ok {
+		return nil, errors.New("keys: wrong passphrase or corrupt identity file")
+	}
+
+	var priv [32]byte
+	copy(priv[:], opened)
+	return &priv, nil
+}
+
+func deriveKey(passphrase string, salt []byte) ([32]byte, error) {
+	var key [32]byte
+	derived, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return key, err
+	}
+	copy(key[:], derived)
+	return key, nil
+}
@@ -0,0 +1,122 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/joshuaparmenter/UNITE/wire"
+)
+
+// BoltStore is a Store backed by a BoltDB file, keeping one bucket per
+// user with monotonically-increasing keys so Drain reads messages back
+// in the order they were queued. Unlike Memory, queued messages survive
+// a server restart.
+type BoltStore struct {
+	db *bolt.DB
+
+	// MaxPerUser and TTL apply the same eviction policy as Memory.
+	MaxPerUser int
+	TTL        time.Duration
+}
+
+// OpenBolt opens (creating if needed) the BoltDB file at path.
+func OpenBolt(path string, maxPerUser int, ttl time.Duration) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0o600, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &BoltStore{db: db, MaxPerUser: maxPerUser, TTL: ttl}, nil
+}
+
+// Close releases the underlying BoltDB file.
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// queuedMessage is the JSON value stored under each key, wrapping the
+// wire message with the time it was queued so Drain can apply TTL.
+type queuedMessage struct {
+	Msg    wire.Message `json:"msg"`
+	Queued time.Time    `json:"queued"`
+}
+
+func (s *BoltStore) Enqueue(user string, msg wire.Message) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(user))
+		if err != nil {
+			return err
+		}
+
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(queuedMessage{Msg: msg, Queued: time.Now()})
+		if err != nil {
+			return err
+		}
+		if err := b.Put(itob(seq), data); err != nil {
+			return err
+		}
+		return s.evict(b)
+	})
+}
+
+// evict drops the oldest entries once the bucket holds more than
+// MaxPerUser messages. It counts keys with the bucket's own cursor
+// rather than Bucket.Stats(), whose counters are only refreshed between
+// transactions and so don't see puts made earlier in this same update.
+func (s *BoltStore) evict(b *bolt.Bucket) error {
+	if s.MaxPerUser <= 0 {
+		return nil
+	}
+	c := b.Cursor()
+	n := 0
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		n++
+	}
+	for k, _ := c.First(); k != nil && n > s.MaxPerUser; k, _ = c.Next() {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+		n--
+	}
+	return nil
+}
+
+func (s *BoltStore) Drain(user string) ([]wire.Message, error) {
+	var out []wire.Message
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(user))
+		if b == nil {
+			return nil
+		}
+
+		now := time.Now()
+		if err := b.ForEach(func(_, v []byte) error {
+			var qm queuedMessage
+			if err := json.Unmarshal(v, &qm); err != nil {
+				return err
+			}
+			if s.TTL > 0 && now.Sub(qm.Queued) > s.TTL {
+				return nil
+			}
+			out = append(out, qm.Msg)
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		return tx.DeleteBucket([]byte(user))
+	})
+	return out, err
+}
+
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
@@ -0,0 +1,77 @@
+// Package store persists messages sent to offline users so they can be
+// delivered the next time the recipient connects.
+package store
+
+import (
+	"sync"
+	"time"
+
+	"github.com/joshuaparmenter/UNITE/wire"
+)
+
+// Store queues messages for users who are not currently connected.
+type Store interface {
+	// Enqueue saves msg for later delivery to user.
+	Enqueue(user string, msg wire.Message) error
+	// Drain returns and removes every message queued for user.
+	Drain(user string) ([]wire.Message, error)
+}
+
+type memoryEntry struct {
+	msg    wire.Message
+	queued time.Time
+}
+
+// Memory is an in-process Store backed by a map. It does not survive a
+// server restart; use BoltStore for that.
+type Memory struct {
+	mu     sync.Mutex
+	queues map[string][]memoryEntry
+
+	// MaxPerUser caps how many messages are kept per user; older
+	// messages are dropped once the cap is exceeded. Zero means
+	// unbounded.
+	MaxPerUser int
+	// TTL discards messages older than this once Drain is called.
+	// Zero means messages never expire.
+	TTL time.Duration
+}
+
+// NewMemory returns an empty Memory store with the given eviction
+// policy.
+func NewMemory(maxPerUser int, ttl time.Duration) *Memory {
+	return &Memory{
+		queues:     make(map[string][]memoryEntry),
+		MaxPerUser: maxPerUser,
+		TTL:        ttl,
+	}
+}
+
+func (m *Memory) Enqueue(user string, msg wire.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	q := append(m.queues[user], memoryEntry{msg: msg, queued: time.Now()})
+	if m.MaxPerUser > 0 && len(q) > m.MaxPerUser {
+		q = q[len(q)-m.MaxPerUser:]
+	}
+	m.queues[user] = q
+	return nil
+}
+
+func (m *Memory) Drain(user string) ([]wire.Message, error) {
+	m.mu.Lock()
+	q := m.queues[user]
+	delete(m.queues, user)
+	m.mu.Unlock()
+
+	out := make([]wire.Message, 0, len(q))
+	now := time.Now()
+	for _, e := range q {
+		if m.TTL > 0 && now.Sub(e.queued) > m.TTL {
+			continue
+		}
+		out = append(out, e.msg)
+	}
+	return out, nil
+}
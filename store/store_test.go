@@ -0,0 +1,119 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/joshuaparmenter/UNITE/wire"
+)
+
+// newStores returns a Memory and a BoltStore sharing the same eviction
+// policy, so the table-driven tests below exercise both backends
+// identically.
+func newStores(t *testing.T, maxPerUser int, ttl time.Duration) map[string]Store {
+	t.Helper()
+
+	bolt, err := OpenBolt(filepath.Join(t.TempDir(), "queue.db"), maxPerUser, ttl)
+	if err != nil {
+		t.Fatalf("OpenBolt: %v", err)
+	}
+	t.Cleanup(func() { bolt.Close() })
+
+	return map[string]Store{
+		"Memory":    NewMemory(maxPerUser, ttl),
+		"BoltStore": bolt,
+	}
+}
+
+func TestEnqueueDrainOrder(t *testing.T) {
+	for name, s := range newStores(t, 0, 0) {
+		t.Run(name, func(t *testing.T) {
+			for _, text := range []string{"one", "two", "three"} {
+				if err := s.Enqueue("alice", wire.Message{Type: "dm", Text: text}); err != nil {
+					t.Fatalf("Enqueue: %v", err)
+				}
+			}
+
+			got, err := s.Drain("alice")
+			if err != nil {
+				t.Fatalf("Drain: %v", err)
+			}
+			want := []string{"one", "two", "three"}
+			if len(got) != len(want) {
+				t.Fatalf("Drain returned %d messages, want %d", len(got), len(want))
+			}
+			for i, text := range want {
+				if got[i].Text != text {
+					t.Fatalf("message %d = %q, want %q", i, got[i].Text, text)
+				}
+			}
+		})
+	}
+}
+
+func TestDrainEmptiesTheQueue(t *testing.T) {
+	for name, s := range newStores(t, 0, 0) {
+		t.Run(name, func(t *testing.T) {
+			if err := s.Enqueue("alice", wire.Message{Type: "dm", Text: "hi"}); err != nil {
+				t.Fatalf("Enqueue: %v", err)
+			}
+			if _, err := s.Drain("alice"); err != nil {
+				t.Fatalf("Drain: %v", err)
+			}
+
+			got, err := s.Drain("alice")
+			if err != nil {
+				t.Fatalf("second Drain: %v", err)
+			}
+			if len(got) != 0 {
+				t.Fatalf("second Drain returned %d messages, want 0", len(got))
+			}
+		})
+	}
+}
+
+func TestMaxPerUserEvictsOldest(t *testing.T) {
+	for name, s := range newStores(t, 2, 0) {
+		t.Run(name, func(t *testing.T) {
+			for _, text := range []string{"one", "two", "three"} {
+				if err := s.Enqueue("alice", wire.Message{Type: "dm", Text: text}); err != nil {
+					t.Fatalf("Enqueue: %v", err)
+				}
+			}
+
+			got, err := s.Drain("alice")
+			if err != nil {
+				t.Fatalf("Drain: %v", err)
+			}
+			want := []string{"two", "three"}
+			if len(got) != len(want) {
+				t.Fatalf("Drain returned %d messages, want %d", len(got), len(want))
+			}
+			for i, text := range want {
+				if got[i].Text != text {
+					t.Fatalf("message %d = %q, want %q", i, got[i].Text, text)
+				}
+			}
+		})
+	}
+}
+
+func TestTTLDropsExpiredMessages(t *testing.T) {
+	for name, s := range newStores(t, 0, time.Millisecond) {
+		t.Run(name, func(t *testing.T) {
+			if err := s.Enqueue("alice", wire.Message{Type: "dm", Text: "stale"}); err != nil {
+				t.Fatalf("Enqueue: %v", err)
+			}
+			time.Sleep(5 * time.Millisecond)
+
+			got, err := s.Drain("alice")
+			if err != nil {
+				t.Fatalf("Drain: %v", err)
+			}
+			if len(got) != 0 {
+				t.Fatalf("Drain returned %d expired messages, want 0", len(got))
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+// Package wire implements UNITE's framing layer: turning a stream of
+// bytes on a net.Conn into discrete Message values and back, without
+// relying on a single fixed-size read per message.
+package wire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Message is the payload exchanged between clients and the server.
+//
+// Type selects how the server interprets the rest of the fields:
+//   - "auth":      Code is the pre-shared connection code, sent first.
+//   - "register":  User is the nickname the connection wants to claim;
+//     PublicKey is its NaCl box public key.
+//   - "lookup":    To is the nickname whose PublicKey is being requested;
+//     the server replies with another "lookup" carrying From/PublicKey.
+//   - "dm":        From/To identify sender/recipient. Once end-to-end
+//     encryption is in use, Text is empty and Nonce/Ciphertext carry the
+//     sealed payload instead; the server never sees the plaintext.
+//   - "broadcast": server-originated presence notice, Text is human readable.
+//   - "ack":       server confirms an auth, register or dm succeeded.
+//   - "error":     server reports a problem (unknown recipient, taken nick, ...).
+//   - "shutdown":  server is going away and the connection will be closed.
+type Message struct {
+	Type       string `json:"type"`
+	User       string `json:"user,omitempty"`
+	From       string `json:"from,omitempty"`
+	To         string `json:"to,omitempty"`
+	Code       string `json:"code,omitempty"`
+	PublicKey  []byte `json:"public_key,omitempty"`
+	Nonce      []byte `json:"nonce,omitempty"`
+	Ciphertext []byte `json:"ciphertext,omitempty"`
+	Text       string `json:"text"`
+}
+
+// DefaultMaxReadBytes is the maxReadBytes callers should pass to
+// ReadMessage/NewLineScanner when they have no more specific limit of
+// their own to enforce.
+const DefaultMaxReadBytes = 1 << 20 // 1 MiB
+
+// WriteMessage writes msg to w as a 4-byte big-endian length prefix
+// followed by its JSON encoding.
+func WriteMessage(w io.Writer, msg Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(data)))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// ReadMessage reads one length-prefixed frame from r and decodes it as a
+// Message. It returns an error if the declared length exceeds
+// maxReadBytes; a maxReadBytes of 0 disables the check.
+func ReadMessage(r io.Reader, maxReadBytes uint32) (Message, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return Message{}, err
+	}
+
+	n := binary.BigEndian.Uint32(hdr[:])
+	if maxReadBytes > 0 && n > maxReadBytes {
+		return Message{}, fmt.Errorf("wire: frame of %d bytes exceeds maxReadBytes of %d", n, maxReadBytes)
+	}
+
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return Message{}, err
+	}
+
+	var msg Message
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return Message{}, err
+	}
+	return msg, nil
+}
+
+// NewLineScanner returns a bufio.Scanner configured to split r on '\n',
+// with its buffer raised so a single JSON line up to maxReadBytes fits.
+// It backs the NDJSON mode used by ReadMessageLine, which lets a client
+// as simple as telnet drive the protocol one line at a time.
+func NewLineScanner(r io.Reader, maxReadBytes uint32) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), int(maxReadBytes))
+	return scanner
+}
+
+// ReadMessageLine reads one newline-delimited JSON message from scanner.
+// It returns io.EOF once the underlying stream is exhausted.
+func ReadMessageLine(scanner *bufio.Scanner) (Message, error) {
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return Message{}, err
+		}
+		return Message{}, io.EOF
+	}
+
+	var msg Message
+	if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+		return Message{}, err
+	}
+	return msg, nil
+}
+
+// WriteMessageLine writes msg to w as JSON followed by '\n', the
+// counterpart to ReadMessageLine.
+func WriteMessageLine(w io.Writer, msg Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	_, err = w.Write(data)
+	return err
+}
@@ -0,0 +1,69 @@
+package wire
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestWriteReadMessageRoundTrip(t *testing.T) {
+	want := Message{
+		Type:       "dm",
+		From:       "alice",
+		To:         "bob",
+		Nonce:      []byte{1, 2, 3},
+		Ciphertext: []byte("sealed"),
+	}
+
+	var buf bytes.Buffer
+	if err := WriteMessage(&buf, want); err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+
+	got, err := ReadMessage(&buf, DefaultMaxReadBytes)
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	if got.Type != want.Type || got.From != want.From || got.To != want.To {
+		t.Fatalf("ReadMessage = %+v, want %+v", got, want)
+	}
+	if !bytes.Equal(got.Nonce, want.Nonce) || !bytes.Equal(got.Ciphertext, want.Ciphertext) {
+		t.Fatalf("ReadMessage = %+v, want %+v", got, want)
+	}
+}
+
+func TestReadMessageRejectsOversizedFrame(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteMessage(&buf, Message{Type: "broadcast", Text: "this is too long"}); err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+
+	if _, err := ReadMessage(&buf, 4); err == nil {
+		t.Fatal("ReadMessage succeeded on a frame larger than maxReadBytes, want error")
+	}
+}
+
+func TestWriteReadMessageLineRoundTrip(t *testing.T) {
+	want := Message{Type: "lookup", To: "bob"}
+
+	var buf bytes.Buffer
+	if err := WriteMessageLine(&buf, want); err != nil {
+		t.Fatalf("WriteMessageLine: %v", err)
+	}
+
+	scanner := NewLineScanner(&buf, DefaultMaxReadBytes)
+	got, err := ReadMessageLine(scanner)
+	if err != nil {
+		t.Fatalf("ReadMessageLine: %v", err)
+	}
+	if got.Type != want.Type || got.To != want.To {
+		t.Fatalf("ReadMessageLine = %+v, want %+v", got, want)
+	}
+}
+
+func TestReadMessageLineEOF(t *testing.T) {
+	scanner := NewLineScanner(&bytes.Buffer{}, DefaultMaxReadBytes)
+	if _, err := ReadMessageLine(scanner); err != io.EOF {
+		t.Fatalf("ReadMessageLine on empty stream = %v, want io.EOF", err)
+	}
+}